@@ -0,0 +1,32 @@
+// Copyright © 2022 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// cleanupRowsDeletedTotal and cleanupDurationSeconds back
+// Persister.CleanupDatabase's per-entity progress reporting, letting
+// operators running Kratos at scale alert on a stalled or slow cleanup
+// job instead of discovering it only once expired rows pile up.
+var (
+	cleanupRowsDeletedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kratos_cleanup_rows_deleted_total",
+			Help: "Total number of rows deleted by Persister.CleanupDatabase, partitioned by entity. Entities whose cleanup does not report a row count are not counted.",
+		},
+		[]string{"entity"},
+	)
+
+	cleanupDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "kratos_cleanup_duration_seconds",
+			Help: "Duration of each entity's cleanup job within a Persister.CleanupDatabase run.",
+		},
+		[]string{"entity"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cleanupRowsDeletedTotal, cleanupDurationSeconds)
+}
@@ -7,8 +7,19 @@ import (
 	"context"
 	"embed"
 	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	otelTrace "go.opentelemetry.io/otel/trace"
+
 	"github.com/ory/x/contextx"
 
 	"github.com/ory/x/fsx"
@@ -16,6 +27,7 @@ import (
 	"github.com/gobuffalo/pop/v6"
 	"github.com/gobuffalo/pop/v6/columns"
 	"github.com/gofrs/uuid"
+	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 
 	"github.com/ory/x/networkx"
@@ -45,16 +57,32 @@ type (
 		x.TracingProvider
 	}
 	Persister struct {
-		nid      uuid.UUID
-		c        *pop.Connection
-		mb       *popx.MigrationBox
-		mbs      popx.MigrationStatuses
-		r        persisterDependencies
-		p        *networkx.Manager
-		isSQLite bool
+		nid                uuid.UUID
+		c                  *pop.Connection
+		replicas           []*pop.Connection
+		replicaPolicy      ReadReplicaPolicy
+		replicaLagWindow   time.Duration
+		replicaRR          uint64
+		replicaLoad        []int64
+		mb                 *popx.MigrationBox
+		mbs                popx.MigrationStatuses
+		r                  persisterDependencies
+		p                  *networkx.Manager
+		isSQLite           bool
+		softDeleteGrace    time.Duration
+		cleanupConcurrency int
 	}
 )
 
+// defaultSoftDeleteGrace is how long a soft-deleted row survives before
+// PurgeSoftDeleted is allowed to reap it, unless overridden by
+// SetSoftDeleteGrace.
+const defaultSoftDeleteGrace = 7 * 24 * time.Hour
+
+// defaultCleanupConcurrency is CleanupDatabase's worker pool size unless
+// overridden by SetCleanupConcurrency.
+const defaultCleanupConcurrency = 4
+
 func NewPersister(ctx context.Context, r persisterDependencies, c *pop.Connection) (*Persister, error) {
 	m, err := popx.NewMigrationBox(fsx.Merge(migrations, networkx.Migrations), popx.NewMigrator(c, r.Logger(), r.Tracer(ctx), 0))
 	if err != nil {
@@ -64,10 +92,70 @@ func NewPersister(ctx context.Context, r persisterDependencies, c *pop.Connectio
 
 	return &Persister{
 		c: c, mb: m, r: r, isSQLite: c.Dialect.Name() == "sqlite3",
-		p: networkx.NewManager(c, r.Logger(), r.Tracer(ctx)),
+		p:                  networkx.NewManager(c, r.Logger(), r.Tracer(ctx)),
+		softDeleteGrace:    defaultSoftDeleteGrace,
+		cleanupConcurrency: defaultCleanupConcurrency,
 	}, nil
 }
 
+// SetSoftDeleteGrace overrides how long a soft-deleted row survives
+// before CleanupDatabase's PurgeSoftDeleted jobs are allowed to reap it.
+// Call this before the first CleanupDatabase run; it is not safe for
+// concurrent use with one.
+func (p *Persister) SetSoftDeleteGrace(grace time.Duration) {
+	p.softDeleteGrace = grace
+}
+
+// SetCleanupConcurrency overrides how many of CleanupDatabase's per-entity
+// jobs are allowed to run at once. Call this before the first
+// CleanupDatabase run; it is not safe for concurrent use with one.
+func (p *Persister) SetCleanupConcurrency(concurrency int) {
+	p.cleanupConcurrency = concurrency
+}
+
+// defaultReplicaLagWindow is how long GetReadConnection sticks to
+// primary, after a write on a stickiness-enabled context, before
+// trusting a replica again. Callers reading dsn.read_replicas.lag_window
+// out of config pass it to NewPersisterWithReplicas explicitly; this is
+// only the fallback when that's zero.
+const defaultReplicaLagWindow = 2 * time.Second
+
+// NewPersisterWithReplicas builds on NewPersister, additionally wiring
+// up read-replica connections for GetReadConnection to route read-only
+// queries to. Writes and transactions always stay on primary. policy and
+// lagWindow are driven by the dsn.read_replicas config block; policy
+// defaults to ReadReplicaRoundRobin and lagWindow to
+// defaultReplicaLagWindow when left zero.
+//
+// WIP: this package's List*/Get*/Count* read methods live outside
+// persister.go and none of them call GetReadConnection yet, so
+// configuring replicas here does not yet change where any read actually
+// goes -- that wiring is unfinished follow-up work, not shipped by this
+// change. MigrationStatus deliberately stays off GetReadConnection even
+// once that follow-up lands: migration state must reflect what was just
+// applied, not a possibly-lagging replica's view of it.
+func NewPersisterWithReplicas(ctx context.Context, r persisterDependencies, primary *pop.Connection, replicas []*pop.Connection, policy ReadReplicaPolicy, lagWindow time.Duration) (*Persister, error) {
+	p, err := NewPersister(ctx, r, primary)
+	if err != nil {
+		return nil, err
+	}
+
+	p.replicas = replicas
+	p.replicaLoad = make([]int64, len(replicas))
+
+	p.replicaPolicy = policy
+	if p.replicaPolicy == "" {
+		p.replicaPolicy = ReadReplicaRoundRobin
+	}
+
+	p.replicaLagWindow = lagWindow
+	if p.replicaLagWindow <= 0 {
+		p.replicaLagWindow = defaultReplicaLagWindow
+	}
+
+	return p, nil
+}
+
 func (p *Persister) NetworkID(ctx context.Context) uuid.UUID {
 	return p.r.Contextualizer().Network(ctx, p.nid)
 }
@@ -85,6 +173,104 @@ func (p *Persister) Connection(ctx context.Context) *pop.Connection {
 	return p.c.WithContext(ctx)
 }
 
+// ReadReplicaPolicy selects how GetReadConnection spreads load across
+// configured replicas.
+type ReadReplicaPolicy string
+
+const (
+	ReadReplicaRoundRobin       ReadReplicaPolicy = "round_robin"
+	ReadReplicaLeastOutstanding ReadReplicaPolicy = "least_outstanding_queries"
+)
+
+// replicaOutstandingDecay is how long chooseLeastOutstandingReplica
+// counts a read against a replica's load before assuming it finished.
+// Persister has no hook into pop's query lifecycle to decrement the
+// counter exactly when a read completes, so this is a proxy, not an
+// exact in-flight count.
+const replicaOutstandingDecay = 50 * time.Millisecond
+
+type stickyWriteContextKey struct{}
+
+// EnableWriteStickiness installs a mutable marker on ctx that update,
+// updateVersioned, delete, and softDelete set every time they write
+// successfully. Call this once per request scope (e.g. in HTTP
+// middleware) and thread the returned context through; GetReadConnection
+// then sticks to primary for any read on that context for
+// replicaLagWindow after the most recent write, giving read-your-writes
+// consistency even though reads are normally spread across replicas. A
+// context never passed through here is untouched by markWriteInContext
+// -- it's a plain no-op -- so existing callers that don't opt in are
+// unaffected.
+func EnableWriteStickiness(ctx context.Context) context.Context {
+	return context.WithValue(ctx, stickyWriteContextKey{}, new(int64))
+}
+
+// markWriteInContext records that a write just happened, for any ctx
+// that was set up by EnableWriteStickiness. It mutates the marker in
+// place rather than returning a new context, since update/delete and
+// friends return only an error and have no way to hand a new context
+// back to their caller.
+func markWriteInContext(ctx context.Context) {
+	if marker, ok := ctx.Value(stickyWriteContextKey{}).(*int64); ok {
+		atomic.StoreInt64(marker, time.Now().UnixNano())
+	}
+}
+
+// GetReadConnection returns the connection a read-only query should run
+// against: a read replica when one is configured, or the primary
+// otherwise. It sticks to primary when ctx carries a stickiness marker
+// (see EnableWriteStickiness) that was set within replicaLagWindow, so a
+// read immediately following a write in the same request context
+// doesn't race a lagging replica. This is the building block List*/
+// Get*/Count* persister methods should call instead of Connection for
+// their read-only queries; this package's List*/Get*/Count* methods
+// live outside persister.go and aren't touched by this change, so wiring
+// them over to GetReadConnection is follow-up work, not done here.
+// MigrationStatus stays on p.mb's own connection deliberately: migration
+// state must reflect what was just applied, not a possibly-lagging
+// replica's view of it.
+func (p *Persister) GetReadConnection(ctx context.Context) *pop.Connection {
+	if len(p.replicas) == 0 {
+		return p.Connection(ctx)
+	}
+
+	if marker, ok := ctx.Value(stickyWriteContextKey{}).(*int64); ok {
+		if writtenAt := atomic.LoadInt64(marker); writtenAt != 0 {
+			if time.Since(time.Unix(0, writtenAt)) < p.replicaLagWindow {
+				return p.Connection(ctx)
+			}
+		}
+	}
+
+	return p.chooseReplica().WithContext(ctx)
+}
+
+func (p *Persister) chooseReplica() *pop.Connection {
+	if p.replicaPolicy == ReadReplicaLeastOutstanding {
+		return p.chooseLeastOutstandingReplica()
+	}
+
+	idx := atomic.AddUint64(&p.replicaRR, 1) % uint64(len(p.replicas))
+	return p.replicas[idx]
+}
+
+// chooseLeastOutstandingReplica picks the replica with the fewest
+// in-flight reads, per replicaLoad, and decays its count back down
+// after replicaOutstandingDecay.
+func (p *Persister) chooseLeastOutstandingReplica() *pop.Connection {
+	best := 0
+	for i := 1; i < len(p.replicaLoad); i++ {
+		if atomic.LoadInt64(&p.replicaLoad[i]) < atomic.LoadInt64(&p.replicaLoad[best]) {
+			best = i
+		}
+	}
+
+	atomic.AddInt64(&p.replicaLoad[best], 1)
+	time.AfterFunc(replicaOutstandingDecay, func() { atomic.AddInt64(&p.replicaLoad[best], -1) })
+
+	return p.replicas[best]
+}
+
 func (p *Persister) MigrationStatus(ctx context.Context) (popx.MigrationStatuses, error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.MigrationStatus")
 	defer span.End()
@@ -113,6 +299,348 @@ func (p *Persister) MigrateUp(ctx context.Context) error {
 	return p.mb.Up(ctx)
 }
 
+// MigrationDiff is one pending migration as MigrationPlan or
+// MigrateUpDryRun describes it, without actually applying it.
+type MigrationDiff struct {
+	Version    string
+	Name       string
+	Statements []string
+	// Warnings flags statements known to take table locks long enough to
+	// matter in production, e.g. an ALTER TABLE ... ADD COLUMN NOT NULL
+	// on MySQL or a non-CONCURRENTLY index creation on Postgres.
+	Warnings []string
+	// EstimatedRowsTouched sums the query planner's row estimate, via
+	// EXPLAIN, across this migration's UPDATE/DELETE/INSERT statements.
+	// It is rowsUnestimated when the migration is pure DDL or its
+	// dialect/statements couldn't be estimated.
+	EstimatedRowsTouched int
+}
+
+// rowsUnestimated marks MigrationDiff.EstimatedRowsTouched as not
+// computed, as opposed to a migration genuinely touching zero rows.
+const rowsUnestimated = -1
+
+// MigrationPlan describes the migrations MigrateUp would apply next,
+// by reading the same embedded migrations/sql/*.sql tree popx.MigrationBox
+// consults, without running any of it. MigrateUpDryRun returns the same
+// slice, and FormatMigrationPlan renders it as a text report.
+func (p *Persister) MigrationPlan(ctx context.Context) ([]MigrationDiff, error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.MigrationPlan")
+	defer span.End()
+
+	statuses, err := p.mb.Status(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	dialect := p.c.Dialect.Name()
+
+	var plan []MigrationDiff
+	for _, status := range statuses {
+		if status.Applied {
+			continue
+		}
+
+		statements, err := p.pendingMigrationStatements(status.Version, dialect)
+		if err != nil {
+			return nil, err
+		}
+
+		plan = append(plan, MigrationDiff{
+			Version:              status.Version,
+			Name:                 status.Name,
+			Statements:           statements,
+			Warnings:             classifyMigrationWarnings(statements, dialect),
+			EstimatedRowsTouched: p.estimateRowsTouched(ctx, dialect, statements),
+		})
+	}
+
+	return plan, nil
+}
+
+// dmlStatement matches the statement types EXPLAIN can give a meaningful
+// row estimate for. A CREATE TABLE/ALTER TABLE DDL statement has no rows
+// to touch, so there's nothing useful to EXPLAIN.
+var dmlStatement = regexp.MustCompile(`(?i)^\s*(UPDATE|DELETE|INSERT)\b`)
+
+// estimateRowsTouched sums the query planner's row estimate, via
+// EXPLAIN, across statements' UPDATE/DELETE/INSERT statements. Running
+// plain EXPLAIN (not EXPLAIN ANALYZE) doesn't execute the statement, so
+// this is safe to call during a dry run. It returns rowsUnestimated when
+// none of the statements are DML, the dialect isn't supported, or the
+// EXPLAIN output couldn't be parsed.
+func (p *Persister) estimateRowsTouched(ctx context.Context, dialect string, statements []string) int {
+	total := 0
+	estimated := false
+	for _, stmt := range statements {
+		if !dmlStatement.MatchString(stmt) {
+			continue
+		}
+
+		var rows int
+		var err error
+		switch dialect {
+		case "postgres", "cockroach":
+			rows, err = p.explainPostgresRows(ctx, stmt)
+		case "mysql":
+			rows, err = p.explainMySQLRows(ctx, stmt)
+		default:
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		total += rows
+		estimated = true
+	}
+
+	if !estimated {
+		return rowsUnestimated
+	}
+	return total
+}
+
+// explainPostgresRowsPattern pulls the planner's row estimate out of a
+// line of EXPLAIN output, e.g. "Seq Scan on users  (cost=0.00..1.05 rows=5 width=32)".
+var explainPostgresRowsPattern = regexp.MustCompile(`rows=(\d+)`)
+
+func (p *Persister) explainPostgresRows(ctx context.Context, stmt string) (int, error) {
+	var plan []struct {
+		QueryPlan string `db:"QUERY PLAN"`
+	}
+	if err := p.c.WithContext(ctx).RawQuery("EXPLAIN " + stmt).All(&plan); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	for _, line := range plan {
+		if m := explainPostgresRowsPattern.FindStringSubmatch(line.QueryPlan); m != nil {
+			rows, err := strconv.Atoi(m[1])
+			if err == nil {
+				return rows, nil
+			}
+		}
+	}
+	return 0, errors.New("no row estimate found in EXPLAIN output")
+}
+
+func (p *Persister) explainMySQLRows(ctx context.Context, stmt string) (int, error) {
+	var plan []struct {
+		Rows int `db:"rows"`
+	}
+	if err := p.c.WithContext(ctx).RawQuery("EXPLAIN " + stmt).All(&plan); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if len(plan) == 0 {
+		return 0, errors.New("EXPLAIN returned no rows")
+	}
+
+	total := 0
+	for _, row := range plan {
+		total += row.Rows
+	}
+	return total, nil
+}
+
+// MigrateUpDryRun is an alias for MigrationPlan: it surfaces, for each
+// pending migration, the SQL statements MigrateUp would run and a
+// warning classification for statements known to take table locks, so
+// operators can review destructive or long-running migrations before
+// applying them in production.
+func (p *Persister) MigrateUpDryRun(ctx context.Context) ([]MigrationDiff, error) {
+	return p.MigrationPlan(ctx)
+}
+
+// FormatMigrationPlan renders plan as the human-readable report a
+// `kratos migrate sql --dry-run` command would print. Wiring an actual
+// --dry-run flag to this belongs in the cmd/ package, which isn't part
+// of this diff -- this only supplies the formatting that command would
+// call into.
+func FormatMigrationPlan(plan []MigrationDiff) string {
+	if len(plan) == 0 {
+		return "No pending migrations.\n"
+	}
+
+	var b strings.Builder
+	for _, diff := range plan {
+		fmt.Fprintf(&b, "%s %s\n", diff.Version, diff.Name)
+		for _, stmt := range diff.Statements {
+			fmt.Fprintf(&b, "  %s;\n", stmt)
+		}
+		for _, warning := range diff.Warnings {
+			fmt.Fprintf(&b, "  WARNING: %s\n", warning)
+		}
+		if diff.EstimatedRowsTouched != rowsUnestimated {
+			fmt.Fprintf(&b, "  estimated rows touched: %d\n", diff.EstimatedRowsTouched)
+		}
+	}
+	return b.String()
+}
+
+// pendingMigrationStatements reads the raw SQL for the up migration
+// identified by version and dialect out of the embedded migrations tree
+// and splits it into individual statements.
+func (p *Persister) pendingMigrationStatements(version, dialect string) ([]string, error) {
+	migrationsFS := fsx.Merge(migrations, networkx.Migrations)
+	entries, err := fs.ReadDir(migrationsFS, "migrations/sql")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+
+	name, err := selectUpMigrationFile(names, version, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := fs.ReadFile(migrationsFS, path.Join("migrations/sql", name))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return splitSQLStatements(string(content)), nil
+}
+
+// selectUpMigrationFile picks the up-migration file for version and
+// dialect out of names (a migrations/sql directory listing). It must
+// filter on ".up." explicitly: every version also ships a ".down." file,
+// and embed.FS lists directory entries in lexical order, so the down
+// file always sorts before the up one and would otherwise be picked
+// first.
+func selectUpMigrationFile(names []string, version, dialect string) (string, error) {
+	for _, name := range names {
+		if !strings.HasPrefix(name, version) {
+			continue
+		}
+		if !strings.Contains(name, ".up.") {
+			continue
+		}
+		if !migrationFileMatchesDialect(name, dialect) {
+			continue
+		}
+		return name, nil
+	}
+
+	return "", errors.Errorf("no migration file found on disk for version %s (%s)", version, dialect)
+}
+
+// migrationDialectTokens lists the dialect segments popx migration
+// filenames carry for a dialect-specific variant, e.g.
+// "1_create_x.mysql.up.sql". There is no dedicated "dialect-agnostic"
+// marker token: a migration meant for every dialect is simply named
+// without any of these segments.
+var migrationDialectTokens = []string{"mysql", "postgres", "cockroach", "sqlite3"}
+
+// migrationFileMatchesDialect reports whether name is the right file to
+// read for dialect: either it's explicitly tagged for dialect, or it
+// carries none of the known dialect tokens at all, meaning it applies to
+// every dialect.
+func migrationFileMatchesDialect(name, dialect string) bool {
+	if strings.Contains(name, "."+dialect+".") {
+		return true
+	}
+	for _, token := range migrationDialectTokens {
+		if strings.Contains(name, "."+token+".") {
+			return false
+		}
+	}
+	return true
+}
+
+// splitSQLStatements splits sql into individual statements on top-level
+// semicolons, skipping over ones inside a single-quoted string literal or
+// a Postgres dollar-quoted body (e.g. a function or trigger definition)
+// so a migration with embedded semicolons isn't chopped into garbled
+// partial statements.
+func splitSQLStatements(sql string) []string {
+	var statements []string
+	var stmt strings.Builder
+	inString := false
+	dollarTag := ""
+
+	for i := 0; i < len(sql); {
+		switch {
+		case dollarTag != "":
+			if strings.HasPrefix(sql[i:], dollarTag) {
+				stmt.WriteString(dollarTag)
+				i += len(dollarTag)
+				dollarTag = ""
+				continue
+			}
+			stmt.WriteByte(sql[i])
+			i++
+		case inString:
+			stmt.WriteByte(sql[i])
+			if sql[i] == '\'' {
+				inString = false
+			}
+			i++
+		case sql[i] == '\'':
+			inString = true
+			stmt.WriteByte(sql[i])
+			i++
+		case sql[i] == '$':
+			if tag := dollarQuoteTag.FindString(sql[i:]); tag != "" {
+				dollarTag = tag
+				stmt.WriteString(tag)
+				i += len(tag)
+				continue
+			}
+			stmt.WriteByte(sql[i])
+			i++
+		case sql[i] == ';':
+			if s := strings.TrimSpace(stmt.String()); s != "" {
+				statements = append(statements, s)
+			}
+			stmt.Reset()
+			i++
+		default:
+			stmt.WriteByte(sql[i])
+			i++
+		}
+	}
+	if s := strings.TrimSpace(stmt.String()); s != "" {
+		statements = append(statements, s)
+	}
+	return statements
+}
+
+// dollarQuoteTag matches a Postgres dollar-quote opening/closing tag,
+// e.g. "$$" or "$body$".
+var dollarQuoteTag = regexp.MustCompile(`^\$[A-Za-z0-9_]*\$`)
+
+var (
+	mysqlAddNotNullColumn   = regexp.MustCompile(`(?i)ALTER\s+TABLE\s+\S+\s+ADD\s+COLUMN\s+\S+\s+\S+.*NOT\s+NULL`)
+	postgresCreateIndex     = regexp.MustCompile(`(?i)CREATE\s+(UNIQUE\s+)?INDEX\s+`)
+	postgresConcurrentIndex = regexp.MustCompile(`(?i)CREATE\s+(UNIQUE\s+)?INDEX\s+CONCURRENTLY\b`)
+)
+
+// classifyMigrationWarnings flags statements known to take table locks
+// long enough to matter in production: an ALTER TABLE ... ADD COLUMN
+// NOT NULL on MySQL rewrites the whole table, and a CREATE INDEX
+// without CONCURRENTLY on Postgres holds a write lock for the duration
+// of the build.
+func classifyMigrationWarnings(statements []string, dialect string) []string {
+	var warnings []string
+	for _, stmt := range statements {
+		switch dialect {
+		case "mysql":
+			if mysqlAddNotNullColumn.MatchString(stmt) {
+				warnings = append(warnings, fmt.Sprintf("table lock risk on MySQL: %s", stmt))
+			}
+		case "postgres", "cockroach":
+			if postgresCreateIndex.MatchString(stmt) && !postgresConcurrentIndex.MatchString(stmt) {
+				warnings = append(warnings, fmt.Sprintf("table lock risk on Postgres: %s", stmt))
+			}
+		}
+	}
+	return warnings
+}
+
 func (p *Persister) Migrator() *popx.Migrator {
 	return p.mb.Migrator
 }
@@ -139,57 +667,267 @@ type node interface {
 	GetNID() uuid.UUID
 }
 
-func (p *Persister) CleanupDatabase(ctx context.Context, wait time.Duration, older time.Duration, batchSize int) error {
+// CleanupReport summarizes one CleanupDatabase run: how many rows were
+// reaped and how long it took, broken down per entity, plus whatever
+// error (if any) that entity's cleanup returned. Earlier versions of
+// CleanupDatabase stopped at the first error; returning a report lets
+// operators see what every entity did even when one of them failed.
+type CleanupReport struct {
+	Entities map[string]*EntityCleanupReport
+}
+
+// EntityCleanupReport is CleanupReport's per-entity breakdown.
+//
+// RowsDeleted and Batches are rowsUnknown (-1) for jobs whose underlying
+// method doesn't report how many rows or batches it processed internally.
+type EntityCleanupReport struct {
+	Batches     int
+	RowsDeleted int
+	Duration    time.Duration
+	Err         error
+}
+
+// rowsUnknown marks EntityCleanupReport.RowsDeleted/Batches as unreported
+// by the underlying job, as opposed to zero rows genuinely having been
+// deleted. runCleanupJob skips incrementing cleanupRowsDeletedTotal when
+// RowsDeleted is rowsUnknown.
+const rowsUnknown = -1
+
+type cleanupJob struct {
+	entity string
+	run    func(ctx context.Context) (rowsDeleted, batches int, err error)
+}
+
+// CleanupDatabase reaps expired sessions, continuity containers, self-
+// service flows, and soft-delete tombstones. Each entity's cleanup runs
+// as its own job in a worker pool bounded by cleanupConcurrency (see
+// SetCleanupConcurrency), and every batch loop rechecks ctx.Err() before
+// issuing its next query, so canceling ctx stops the whole run promptly
+// instead of only between entities. A failing or canceled entity no
+// longer aborts the others: CleanupDatabase always runs every job and
+// reports what happened to each of them in the returned CleanupReport.
+// It also returns a non-nil error when any entity failed, so a caller
+// that only checks the returned error -- rather than inspecting
+// CleanupReport.Entities -- still finds out the run wasn't clean.
+func (p *Persister) CleanupDatabase(ctx context.Context, wait time.Duration, older time.Duration, batchSize int) (*CleanupReport, error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CleanupDatabase")
+	defer span.End()
+
 	currentTime := time.Now().Add(-older)
-	p.r.Logger().Printf("Cleaning up records older than %s\n", currentTime)
+	p.r.Logger().WithField("older_than", currentTime).Info("Cleaning up the SQL database")
 
-	p.r.Logger().Println("Cleaning up expired sessions")
-	if err := p.DeleteExpiredSessions(ctx, currentTime, batchSize); err != nil {
-		return err
+	tombstoneTime := time.Now().Add(-p.softDeleteGrace)
+
+	jobs := []cleanupJob{
+		{"sessions", p.batchedCleanupJob(wait, func(ctx context.Context) error { return p.DeleteExpiredSessions(ctx, currentTime, batchSize) })},
+		{"continuity_containers", p.batchedCleanupJob(wait, func(ctx context.Context) error { return p.DeleteExpiredContinuitySessions(ctx, currentTime, batchSize) })},
+		{"login_flows", p.batchedCleanupJob(wait, func(ctx context.Context) error { return p.DeleteExpiredLoginFlows(ctx, currentTime, batchSize) })},
+		{"recovery_flows", p.batchedCleanupJob(wait, func(ctx context.Context) error { return p.DeleteExpiredRecoveryFlows(ctx, currentTime, batchSize) })},
+		{"registration_flows", p.batchedCleanupJob(wait, func(ctx context.Context) error { return p.DeleteExpiredRegistrationFlows(ctx, currentTime, batchSize) })},
+		{"settings_flows", p.batchedCleanupJob(wait, func(ctx context.Context) error { return p.DeleteExpiredSettingsFlows(ctx, currentTime, batchSize) })},
+		{"verification_flows", p.batchedCleanupJob(wait, func(ctx context.Context) error { return p.DeleteExpiredVerificationFlows(ctx, currentTime, batchSize) })},
+	}
+	for _, table := range softDeletableTables {
+		table := table
+		jobs = append(jobs, cleanupJob{
+			entity: "tombstones:" + table.Table,
+			run: func(ctx context.Context) (int, int, error) {
+				rows, err := p.PurgeSoftDeleted(ctx, table.Table, table.Column, tombstoneTime, batchSize)
+				return rows, rowsUnknown, err
+			},
+		})
 	}
-	time.Sleep(wait)
 
-	p.r.Logger().Println("Cleaning up expired continuity containers")
-	if err := p.DeleteExpiredContinuitySessions(ctx, currentTime, batchSize); err != nil {
-		return err
+	concurrency := p.cleanupConcurrency
+	if concurrency < 1 {
+		concurrency = 1
 	}
-	time.Sleep(wait)
 
-	p.r.Logger().Println("Cleaning up expired login flows")
-	if err := p.DeleteExpiredLoginFlows(ctx, currentTime, batchSize); err != nil {
-		return err
+	report := &CleanupReport{Entities: make(map[string]*EntityCleanupReport, len(jobs))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+
+	for _, job := range jobs {
+		job := job
+
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			report.Entities[job.entity] = &EntityCleanupReport{Err: errors.WithStack(ctx.Err())}
+			mu.Unlock()
+			continue
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			entry := p.runCleanupJob(ctx, job)
+
+			mu.Lock()
+			report.Entities[job.entity] = entry
+			mu.Unlock()
+		}()
 	}
-	time.Sleep(wait)
+	wg.Wait()
 
-	p.r.Logger().Println("Cleaning up expired recovery flows")
-	if err := p.DeleteExpiredRecoveryFlows(ctx, currentTime, batchSize); err != nil {
-		return err
+	var failed []string
+	for entity, entry := range report.Entities {
+		if entry.Err != nil {
+			failed = append(failed, entity)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return report, errors.Errorf("cleanup failed for %d of %d entities, see CleanupReport.Entities for details: %s",
+			len(failed), len(report.Entities), strings.Join(failed, ", "))
 	}
-	time.Sleep(wait)
 
-	p.r.Logger().Println("Cleaning up expired registation flows")
-	if err := p.DeleteExpiredRegistrationFlows(ctx, currentTime, batchSize); err != nil {
-		return err
+	p.r.Logger().Println("Successfully cleaned up the latest batch of the SQL database! " +
+		"This should be re-run periodically, to be sure that all expired data is purged.")
+	return report, nil
+}
+
+// runCleanupJob executes a single cleanup job under its own span and
+// records logs and metrics for the outcome, whether it succeeded,
+// failed, or was canceled.
+func (p *Persister) runCleanupJob(ctx context.Context, job cleanupJob) *EntityCleanupReport {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CleanupDatabase.entity",
+		otelTrace.WithAttributes(attribute.String("entity", job.entity)))
+	defer span.End()
+
+	start := time.Now()
+	rows, batches, err := job.run(ctx)
+	duration := time.Since(start)
+
+	cleanupDurationSeconds.WithLabelValues(job.entity).Observe(duration.Seconds())
+	if rows != rowsUnknown && rows > 0 {
+		cleanupRowsDeletedTotal.WithLabelValues(job.entity).Add(float64(rows))
 	}
-	time.Sleep(wait)
 
-	p.r.Logger().Println("Cleaning up expired settings flows")
-	if err := p.DeleteExpiredSettingsFlows(ctx, currentTime, batchSize); err != nil {
-		return err
+	logger := p.r.Logger().
+		WithField("entity", job.entity).
+		WithField("rows_deleted", rows).
+		WithField("batches", batches).
+		WithField("duration", duration.String())
+	if err != nil {
+		span.RecordError(err)
+		logger.WithError(err).Warn("Cleanup job failed")
+	} else {
+		logger.Info("Cleanup job finished")
 	}
-	time.Sleep(wait)
 
-	p.r.Logger().Println("Cleaning up expired verification flows")
-	if err := p.DeleteExpiredVerificationFlows(ctx, currentTime, batchSize); err != nil {
-		return err
+	return &EntityCleanupReport{Batches: batches, RowsDeleted: rows, Duration: duration, Err: err}
+}
+
+// batchedCleanupJob adapts one of the legacy DeleteExpired* methods --
+// which already loop internally in batches of batchSize and report only
+// an error -- into the (rowsDeleted, batches, err) shape CleanupDatabase
+// expects, sleeping wait afterwards the same way the old sequential loop
+// did. Those methods don't report how many rows or batches they
+// processed internally, so this reports rowsUnknown rather than claiming
+// zero rows were deleted; giving real numbers would require changing
+// their signatures to return counts.
+func (p *Persister) batchedCleanupJob(wait time.Duration, run func(ctx context.Context) error) func(ctx context.Context) (int, int, error) {
+	return func(ctx context.Context) (int, int, error) {
+		if err := ctx.Err(); err != nil {
+			return rowsUnknown, 0, errors.WithStack(err)
+		}
+
+		err := run(ctx)
+
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return rowsUnknown, rowsUnknown, errors.WithStack(ctx.Err())
+			case <-time.After(wait):
+			}
+		}
+
+		return rowsUnknown, rowsUnknown, err
 	}
-	time.Sleep(wait)
+}
 
-	p.r.Logger().Println("Successfully cleaned up the latest batch of the SQL database! " +
-		"This should be re-run periodically, to be sure that all expired data is purged.")
-	return nil
+// SoftDeletable is implemented by models whose table carries a
+// tombstone column. When v satisfies it, Persister.delete stamps that
+// column with the current time instead of issuing a hard DELETE,
+// leaving an undo window: an accidentally deleted identity or session
+// can be recovered by an operator clearing the column by hand until
+// PurgeSoftDeleted reaps it.
+type SoftDeletable interface {
+	TableName(ctx context.Context) string
+	SoftDeleteColumn() string
+}
+
+// softDeletableTable pairs a table with the tombstone column its
+// SoftDeletable model actually reports via SoftDeleteColumn. Using the
+// same hardcoded "deleted_at" here as the default for every table would
+// silently stop purging any table whose model picks a different column
+// name -- the entire point of SoftDeleteColumn being a method instead of
+// a constant.
+type softDeletableTable struct {
+	Table  string
+	Column string
+}
+
+// softDeletableTables lists the tables PurgeSoftDeleted sweeps as part
+// of CleanupDatabase's batched loop. Keep in sync with the models that
+// implement SoftDeletable and the column each one returns from
+// SoftDeleteColumn.
+var softDeletableTables = []softDeletableTable{
+	{Table: "identities", Column: "deleted_at"},
+	{Table: "sessions", Column: "deleted_at"},
+}
+
+// PurgeSoftDeleted permanently removes rows from table whose column
+// (its tombstone column, per SoftDeleteColumn) was set before the
+// olderThan cutoff, in batches of at most batchSize. It is the second
+// phase of the soft-delete pipeline: delete marks a row, PurgeSoftDeleted
+// later reaps the tombstone. table and column are always supplied by a
+// trusted SoftDeletable implementation, never by request input.
+func (p *Persister) PurgeSoftDeleted(ctx context.Context, table, column string, olderThan time.Time, batchSize int) (int, error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.PurgeSoftDeleted")
+	defer span.End()
+
+	var purged int
+	for {
+		if err := ctx.Err(); err != nil {
+			return purged, errors.WithStack(err)
+		}
+
+		/* #nosec G201 table and column are static, supplied by trusted callers */
+		count, err := p.GetConnection(ctx).RawQuery(
+			fmt.Sprintf(`DELETE FROM %[1]s WHERE id IN (
+				SELECT id FROM %[1]s WHERE %[2]s IS NOT NULL AND %[2]s < ? LIMIT ?
+			)`, table, column),
+			olderThan, batchSize,
+		).ExecWithCount()
+		if err != nil {
+			return purged, sqlcon.HandleError(err)
+		}
+		purged += count
+		if count < batchSize {
+			return purged, nil
+		}
+	}
+}
+
+// versionedNode is implemented by models that carry an `updated_at`
+// timestamp. updateVersioned uses it as an optimistic concurrency
+// token: the caller passes in the updated_at it last read, and the
+// UPDATE's WHERE clause pins the row to that value, so a concurrent
+// writer that touched the row first causes the statement to affect
+// zero rows instead of silently clobbering the other writer.
+type versionedNode interface {
+	node
+	GetUpdatedAt() time.Time
 }
 
+// update writes v to its table. It affects at most one row, matched by
+// id and nid; if no such row exists it returns sqlcon.ErrNoRows.
 func (p *Persister) update(ctx context.Context, v node, columnNames ...string) error {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.update")
 	defer span.End()
@@ -212,22 +950,89 @@ func (p *Persister) update(ctx context.Context, v node, columnNames ...string) e
 	}
 
 	// #nosec
-	stmt := fmt.Sprintf("SELECT COUNT(id) FROM %s AS %s WHERE %s.id = ? AND %s.nid = ?",
+	stmt := fmt.Sprintf("UPDATE %s AS %s SET %s WHERE %s AND %s.nid = :nid",
 		quoter.Quote(model.TableName()),
 		model.Alias(),
-		model.Alias(),
+		cols.Writeable().QuotedUpdateString(quoter),
+		model.WhereNamedID(),
 		model.Alias(),
 	)
 
-	var count int
-	if err := c.Store.GetContext(ctx, &count, c.Dialect.TranslateSQL(stmt), v.GetID(), v.GetNID()); err != nil {
+	result, err := c.Store.NamedExecContext(ctx, stmt, v)
+	if err != nil {
 		return sqlcon.HandleError(err)
-	} else if count == 0 {
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if affected == 0 {
 		return errors.WithStack(sqlcon.ErrNoRows)
 	}
+	markWriteInContext(ctx)
+	return nil
+}
+
+// updateVersionedColumnNames returns the columns updateVersioned should
+// write: columnNames as given when the caller didn't restrict the write
+// to particular columns, or columnNames with "updated_at" forced in
+// otherwise. updated_at is the CAS token itself: if an explicit
+// columnNames omitted it, the WHERE predicate would keep matching
+// expectedUpdatedAt on every subsequent write, so two concurrent
+// updateVersioned calls using the same expected value would both
+// succeed and the CAS would never trip.
+func updateVersionedColumnNames(columnNames []string) []string {
+	if len(columnNames) == 0 {
+		return nil
+	}
+	for _, c := range columnNames {
+		if c == "updated_at" {
+			return columnNames
+		}
+	}
+	out := make([]string, len(columnNames), len(columnNames)+1)
+	copy(out, columnNames)
+	return append(out, "updated_at")
+}
+
+// updateVersioned is update's optimistic-concurrency variant: the
+// UPDATE only takes effect if the row's updated_at still matches
+// expectedUpdatedAt, the value the caller read v from. v only carries
+// the *new* updated_at it's being written with, so expectedUpdatedAt
+// can't be derived from v itself -- it has to be bound as its own
+// parameter, which is why this expands v's named placeholders with
+// sqlx.Named and appends expectedUpdatedAt as an extra positional bind
+// rather than trying to smuggle a second value through v's single
+// updated_at field.
+//
+// If the UPDATE affects zero rows, that alone doesn't say whether the
+// row was concurrently modified or simply no longer exists, so this
+// re-checks existence before deciding which of sqlcon.ErrNoRows or
+// sqlcon.ErrConcurrentModification to return.
+func (p *Persister) updateVersioned(ctx context.Context, v versionedNode, expectedUpdatedAt time.Time, columnNames ...string) error {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.updateVersioned")
+	defer span.End()
+
+	c := p.GetConnection(ctx)
+	quoter, ok := c.Dialect.(quotable)
+	if !ok {
+		return errors.Errorf("store is not a quoter: %T", p.c.Store)
+	}
+
+	model := pop.NewModel(v, ctx)
+	tn := model.TableName()
+
+	cols := columns.Columns{}
+	if cn := updateVersionedColumnNames(columnNames); len(cn) > 0 && tn == model.TableName() {
+		cols = columns.NewColumnsWithAlias(tn, model.As, model.IDField())
+		cols.Add(cn...)
+	} else {
+		cols = columns.ForStructWithAlias(v, tn, model.As, model.IDField())
+	}
 
 	// #nosec
-	stmt = fmt.Sprintf("UPDATE %s AS %s SET %s WHERE %s AND %s.nid = :nid",
+	namedStmt := fmt.Sprintf("UPDATE %s AS %s SET %s WHERE %s AND %s.nid = :nid",
 		quoter.Quote(model.TableName()),
 		model.Alias(),
 		cols.Writeable().QuotedUpdateString(quoter),
@@ -235,10 +1040,84 @@ func (p *Persister) update(ctx context.Context, v node, columnNames ...string) e
 		model.Alias(),
 	)
 
-	if _, err := c.Store.NamedExecContext(ctx, stmt, v); err != nil {
+	query, args, err := sqlx.Named(namedStmt, v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	query += fmt.Sprintf(" AND %s.updated_at = ?", model.Alias())
+	args = append(args, expectedUpdatedAt)
+	query = c.Store.Rebind(query)
+
+	result, err := c.Store.ExecContext(ctx, query, args...)
+	if err != nil {
 		return sqlcon.HandleError(err)
 	}
-	return nil
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if affected > 0 {
+		markWriteInContext(ctx)
+		return nil
+	}
+
+	// #nosec
+	existsStmt := fmt.Sprintf("SELECT COUNT(id) FROM %s AS %s WHERE %s.id = ? AND %s.nid = ?",
+		quoter.Quote(model.TableName()), model.Alias(), model.Alias(), model.Alias())
+	var count int
+	if err := c.Store.GetContext(ctx, &count, c.Dialect.TranslateSQL(existsStmt), v.GetID(), v.GetNID()); err != nil {
+		return sqlcon.HandleError(err)
+	}
+	if count == 0 {
+		return errors.WithStack(sqlcon.ErrNoRows)
+	}
+	return errors.WithStack(sqlcon.ErrConcurrentModification)
+}
+
+// updateWithRetry is an optimistic-concurrency-safe alternative to
+// calling update directly. It re-fetches the current row, applies
+// mutate to compute the next version, and attempts updateVersioned
+// against the updated_at fetch returned. If the row was changed
+// concurrently (sqlcon.ErrConcurrentModification), it retries with
+// exponential backoff, up to maxRetries times, before giving up. This
+// lets callers such as the identity, session, and flow persisters
+// safely apply read-modify-write updates when multiple Kratos
+// instances write to the same row.
+func (p *Persister) updateWithRetry(ctx context.Context, maxRetries int, fetch func(ctx context.Context) (versionedNode, error), mutate func(current versionedNode) (versionedNode, error), columnNames ...string) error {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.updateWithRetry")
+	defer span.End()
+
+	backoff := 10 * time.Millisecond
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		current, err := fetch(ctx)
+		if err != nil {
+			return err
+		}
+		expectedUpdatedAt := current.GetUpdatedAt()
+
+		next, err := mutate(current)
+		if err != nil {
+			return err
+		}
+
+		err = p.updateVersioned(ctx, next, expectedUpdatedAt, columnNames...)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, sqlcon.ErrConcurrentModification) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return errors.WithStack(sqlcon.ErrConcurrentModification)
 }
 
 func (p *Persister) delete(ctx context.Context, v interface{}, id uuid.UUID) error {
@@ -247,6 +1126,10 @@ func (p *Persister) delete(ctx context.Context, v interface{}, id uuid.UUID) err
 
 	nid := p.NetworkID(ctx)
 
+	if sd, ok := v.(SoftDeletable); ok {
+		return p.softDelete(ctx, sd, id, nid)
+	}
+
 	tabler, ok := v.(interface {
 		TableName(ctx context.Context) string
 	})
@@ -265,5 +1148,27 @@ func (p *Persister) delete(ctx context.Context, v interface{}, id uuid.UUID) err
 	if count == 0 {
 		return errors.WithStack(sqlcon.ErrNoRows)
 	}
+	markWriteInContext(ctx)
+	return nil
+}
+
+// softDelete stamps v's tombstone column with the current time instead
+// of removing the row, so that CleanupDatabase's later PurgeSoftDeleted
+// sweep (not a restored backup) is what actually reclaims the space.
+func (p *Persister) softDelete(ctx context.Context, v SoftDeletable, id, nid uuid.UUID) error {
+	column := v.SoftDeleteColumn()
+
+	/* #nosec G201 TableName and SoftDeleteColumn are static */
+	count, err := p.GetConnection(ctx).RawQuery(
+		fmt.Sprintf("UPDATE %s SET %s = ? WHERE id = ? AND nid = ? AND %s IS NULL", v.TableName(ctx), column, column),
+		time.Now().UTC(), id, nid,
+	).ExecWithCount()
+	if err != nil {
+		return sqlcon.HandleError(err)
+	}
+	if count == 0 {
+		return errors.WithStack(sqlcon.ErrNoRows)
+	}
+	markWriteInContext(ctx)
 	return nil
 }
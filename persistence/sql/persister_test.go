@@ -0,0 +1,210 @@
+// Copyright © 2022 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"testing"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitSQLStatements(t *testing.T) {
+	for name, tc := range map[string]struct {
+		sql  string
+		want []string
+	}{
+		"simple": {
+			sql:  "CREATE TABLE foo (id uuid);\nALTER TABLE foo ADD COLUMN bar text;",
+			want: []string{"CREATE TABLE foo (id uuid)", "ALTER TABLE foo ADD COLUMN bar text"},
+		},
+		"trailing whitespace and blank statements are dropped": {
+			sql:  "  SELECT 1;  \n;\n\tSELECT 2;  ",
+			want: []string{"SELECT 1", "SELECT 2"},
+		},
+		"semicolon inside a string literal is not a statement boundary": {
+			sql:  `INSERT INTO foo (bar) VALUES ('a;b'); SELECT 1;`,
+			want: []string{`INSERT INTO foo (bar) VALUES ('a;b')`, "SELECT 1"},
+		},
+		"semicolon inside a dollar-quoted function body is not a statement boundary": {
+			sql: `CREATE FUNCTION f() RETURNS trigger AS $$
+BEGIN
+  UPDATE foo SET bar = 1; RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+SELECT 1;`,
+			want: []string{
+				"CREATE FUNCTION f() RETURNS trigger AS $$\nBEGIN\n  UPDATE foo SET bar = 1; RETURN NEW;\nEND;\n$$ LANGUAGE plpgsql",
+				"SELECT 1",
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, splitSQLStatements(tc.sql))
+		})
+	}
+}
+
+func TestClassifyMigrationWarnings(t *testing.T) {
+	for name, tc := range map[string]struct {
+		statements []string
+		dialect    string
+		wantCount  int
+	}{
+		"mysql add not null column warns": {
+			statements: []string{"ALTER TABLE foo ADD COLUMN bar text NOT NULL"},
+			dialect:    "mysql",
+			wantCount:  1,
+		},
+		"mysql nullable column does not warn": {
+			statements: []string{"ALTER TABLE foo ADD COLUMN bar text"},
+			dialect:    "mysql",
+			wantCount:  0,
+		},
+		"postgres non-concurrent index warns": {
+			statements: []string{"CREATE INDEX idx_foo ON foo (bar)"},
+			dialect:    "postgres",
+			wantCount:  1,
+		},
+		"postgres concurrent index does not warn": {
+			statements: []string{"CREATE INDEX CONCURRENTLY idx_foo ON foo (bar)"},
+			dialect:    "postgres",
+			wantCount:  0,
+		},
+		"cockroach inherits postgres rules": {
+			statements: []string{"CREATE UNIQUE INDEX idx_foo ON foo (bar)"},
+			dialect:    "cockroach",
+			wantCount:  1,
+		},
+		"sqlite3 has no classifications": {
+			statements: []string{"ALTER TABLE foo ADD COLUMN bar text NOT NULL", "CREATE INDEX idx_foo ON foo (bar)"},
+			dialect:    "sqlite3",
+			wantCount:  0,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Len(t, classifyMigrationWarnings(tc.statements, tc.dialect), tc.wantCount)
+		})
+	}
+}
+
+func TestMigrationFileMatchesDialect(t *testing.T) {
+	for name, tc := range map[string]struct {
+		file    string
+		dialect string
+		want    bool
+	}{
+		"exact dialect match":                                   {"1_create_identities.mysql.up.sql", "mysql", true},
+		"different dialect is rejected":                         {"1_create_identities.postgres.up.sql", "mysql", false},
+		"dialect-agnostic file matches any dialect":             {"1_create_identities.up.sql", "mysql", true},
+		"dialect-agnostic file matches a different dialect too": {"1_create_identities.up.sql", "cockroach", true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, migrationFileMatchesDialect(tc.file, tc.dialect))
+		})
+	}
+}
+
+func TestSelectUpMigrationFile(t *testing.T) {
+	// embed.FS lists directory entries in lexical order, so the down file
+	// always sorts before the up file for the same version -- this is
+	// the ordering a real migrations/sql directory listing would have.
+	names := []string{
+		"1_create_identities.down.sql",
+		"1_create_identities.up.sql",
+		"2_create_sessions.mysql.down.sql",
+		"2_create_sessions.mysql.up.sql",
+		"2_create_sessions.postgres.down.sql",
+		"2_create_sessions.postgres.up.sql",
+	}
+
+	t.Run("picks the up file, not the lexically-earlier down file", func(t *testing.T) {
+		name, err := selectUpMigrationFile(names, "1", "postgres")
+		assert.NoError(t, err)
+		assert.Equal(t, "1_create_identities.up.sql", name)
+	})
+
+	t.Run("picks the dialect-specific up file", func(t *testing.T) {
+		name, err := selectUpMigrationFile(names, "2", "mysql")
+		assert.NoError(t, err)
+		assert.Equal(t, "2_create_sessions.mysql.up.sql", name)
+	})
+
+	t.Run("errors when no file matches", func(t *testing.T) {
+		_, err := selectUpMigrationFile(names, "3", "postgres")
+		assert.Error(t, err)
+	})
+}
+
+func TestUpdateVersionedColumnNames(t *testing.T) {
+	t.Run("no explicit columns means write every struct field", func(t *testing.T) {
+		assert.Nil(t, updateVersionedColumnNames(nil))
+	})
+
+	t.Run("forces updated_at into an explicit column set that omitted it", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{"name", "updated_at"}, updateVersionedColumnNames([]string{"name"}))
+	})
+
+	t.Run("does not duplicate updated_at when already present", func(t *testing.T) {
+		assert.Equal(t, []string{"name", "updated_at"}, updateVersionedColumnNames([]string{"name", "updated_at"}))
+	})
+
+	t.Run("does not mutate the caller's slice", func(t *testing.T) {
+		columnNames := []string{"name"}
+		_ = updateVersionedColumnNames(columnNames)
+		assert.Equal(t, []string{"name"}, columnNames)
+	})
+}
+
+func TestChooseReplica(t *testing.T) {
+	replicas := []*pop.Connection{{}, {}, {}}
+	p := &Persister{replicas: replicas, replicaPolicy: ReadReplicaRoundRobin}
+
+	seen := map[*pop.Connection]bool{}
+	for i := 0; i < len(replicas)*2; i++ {
+		seen[p.chooseReplica()] = true
+	}
+	assert.Len(t, seen, len(replicas), "round robin should eventually hit every replica")
+}
+
+func TestChooseLeastOutstandingReplica(t *testing.T) {
+	replicas := []*pop.Connection{{}, {}, {}}
+	p := &Persister{
+		replicas:      replicas,
+		replicaPolicy: ReadReplicaLeastOutstanding,
+		replicaLoad:   []int64{5, 0, 3},
+	}
+
+	assert.Same(t, replicas[1], p.chooseLeastOutstandingReplica(), "should pick the replica with the fewest outstanding reads")
+}
+
+func TestFormatMigrationPlan(t *testing.T) {
+	t.Run("empty plan", func(t *testing.T) {
+		assert.Equal(t, "No pending migrations.\n", FormatMigrationPlan(nil))
+	})
+
+	t.Run("renders statements and warnings, omits an unestimated row count", func(t *testing.T) {
+		out := FormatMigrationPlan([]MigrationDiff{{
+			Version:              "1",
+			Name:                 "create_identities",
+			Statements:           []string{"CREATE TABLE identities (id uuid)"},
+			Warnings:             []string{"table lock risk on MySQL: ..."},
+			EstimatedRowsTouched: rowsUnestimated,
+		}})
+		assert.Contains(t, out, "1 create_identities")
+		assert.Contains(t, out, "CREATE TABLE identities (id uuid);")
+		assert.Contains(t, out, "WARNING: table lock risk on MySQL: ...")
+		assert.NotContains(t, out, "estimated rows touched")
+	})
+
+	t.Run("includes row estimate when known", func(t *testing.T) {
+		out := FormatMigrationPlan([]MigrationDiff{{
+			Version:              "1",
+			Name:                 "backfill_identities",
+			Statements:           []string{"UPDATE identities SET nid = '...'"},
+			EstimatedRowsTouched: 42,
+		}})
+		assert.Contains(t, out, "estimated rows touched: 42")
+	})
+}